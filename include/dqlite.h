@@ -113,6 +113,16 @@ DQLITE_API DQLITE_EXPERIMENTAL int dqlite_server_set_auto_bootstrap(
  * @server is starting up for the first time; after the first startup, the list
  * of servers stored on disk will be used instead. (It is harmless to call this
  * function unconditionally.)
+ *
+ * If the default connect function is used and @server is starting up for the
+ * first time, dqlite_server_start will fail with DQLITE_MISUSE if any of these
+ * addresses, or the address passed to dqlite_server_set_address, is not in the
+ * syntax described for dqlite_server_set_bind_address (Unix socket addresses
+ * excluded). Each malformed address is reported in the trace output. Valid
+ * addresses are rewritten in canonical form: the port is made explicit (8080
+ * if none was given), IPv6 hosts are put in brackets and written in lowercase,
+ * and redundant zeros are dropped, so "FE80::0001" becomes "[fe80::1]:8080".
+ * Host names are not accepted.
  */
 DQLITE_API DQLITE_EXPERIMENTAL int dqlite_server_set_auto_join(
     dqlite_server *server,
@@ -160,6 +170,96 @@ DQLITE_API DQLITE_EXPERIMENTAL int dqlite_server_set_connect_func(
     dqlite_connect_func f,
     void *arg);
 
+/**
+ * Set the failure domain of this server.
+ *
+ * The failure domain is an opaque tag, such as a code for the rack or zone the
+ * server runs in. When automatic role management is turned on with
+ * dqlite_server_set_role_management, the leader uses it to spread voters and
+ * standbys across as many failure domains as possible; otherwise it's only
+ * reported to clients that describe the server. The default is 0. This
+ * function must be called before dqlite_server_start.
+ */
+DQLITE_API DQLITE_EXPERIMENTAL int dqlite_server_set_failure_domain(
+    dqlite_server *server,
+    unsigned long long code);
+
+/**
+ * Set the weight of this server.
+ *
+ * When automatic role management (see dqlite_server_set_role_management) is
+ * choosing between otherwise equivalent servers to promote, it prefers the one
+ * with the lowest weight. The default is 0. This function must be called
+ * before dqlite_server_start.
+ */
+DQLITE_API DQLITE_EXPERIMENTAL int dqlite_server_set_weight(
+    dqlite_server *server,
+    unsigned long long weight);
+
+/**
+ * Turn on or off automatic role management for this server.
+ *
+ * When it's on, the server's node runs with dqlite_node_enable_role_management,
+ * so that while it's the leader it promotes and demotes servers to maintain a
+ * set number of voters and standbys, based on their health, failure domain and
+ * weight. New servers join the cluster as spares, and remain spares unless
+ * role management is on. Since any server can become leader, it should be
+ * turned on for every server in the cluster. It's off by default. This
+ * function must be called before dqlite_server_start.
+ */
+DQLITE_API DQLITE_EXPERIMENTAL int dqlite_server_set_role_management(
+    dqlite_server *server,
+    bool on);
+
+/**
+ * Set the interval, in milliseconds, at which the server refreshes its list of
+ * cluster members from the leader.
+ *
+ * The list is kept in memory and persisted to the server's data directory after
+ * each refresh. The default is 30000 (30 seconds). This function must be called
+ * before dqlite_server_start, and @msecs must be nonzero.
+ */
+DQLITE_API DQLITE_EXPERIMENTAL int dqlite_server_set_refresh_period(
+    dqlite_server *server,
+    unsigned msecs);
+
+/**
+ * Configure how this server retries joining the cluster when it starts up as
+ * part of an existing cluster.
+ *
+ * Each attempt consists of finding the leader, fetching the list of cluster
+ * members, and asking the leader to add this server if it's not a member yet.
+ * This means a new server can be started before the rest of the cluster is
+ * reachable, for example by an autoscaler.
+ *
+ * The server will make up to @attempts attempts. It waits @initial_delay
+ * milliseconds after the first failed attempt, and doubles the delay after each
+ * further failure, up to @max_delay milliseconds. By default only one attempt
+ * is made. This function must be called before dqlite_server_start; @attempts
+ * and @initial_delay must be nonzero, and @initial_delay must not be greater
+ * than @max_delay. A zero delay would never grow, so the retries would spin.
+ *
+ * dqlite_server_start blocks until the server has joined or every attempt has
+ * failed, and there is no way to cancel it. Within an attempt, the handshake
+ * with each known server (voters first, then standbys, then spares) may take up
+ * to 5000 milliseconds, and the remaining exchanges with the leader up to 5000
+ * more. With N known servers (the addresses passed to
+ * dqlite_server_set_auto_join on a first start), the call can therefore block
+ * for up to
+ *
+ *   @attempts * (N + 1) * 5000 + (@attempts - 1) * @max_delay
+ *
+ * milliseconds, plus the time spent in the connect function, which is called
+ * up to N + 1 times per attempt. The default connect function uses a blocking
+ * connect(2), whose timeout for an unreachable host is set by the operating
+ * system. Call dqlite_server_start from a thread that can afford to wait.
+ */
+DQLITE_API DQLITE_EXPERIMENTAL int dqlite_server_set_connect_retry(
+    dqlite_server *server,
+    unsigned attempts,
+    unsigned initial_delay,
+    unsigned max_delay);
+
 /**
  * Start running the server.
  *
@@ -212,7 +312,9 @@ DQLITE_API DQLITE_EXPERIMENTAL void dqlite_server_destroy(
 /**
  * Error codes.
  *
- * These are used only with the dqlite_node family of functions.
+ * These are used with the dqlite_node family of functions. The dqlite_server
+ * functions return 1 on failure, except that dqlite_server_start returns
+ * DQLITE_MISUSE for malformed addresses (see dqlite_server_set_auto_join).
  */
 enum {
 	DQLITE_ERROR = 1, /* Generic error */
@@ -332,6 +434,29 @@ DQLITE_API int dqlite_node_set_connect_func(dqlite_node *n,
 						     int *fd),
 					    void *arg);
 
+struct sockaddr; /* Forward declaration */
+
+/**
+ * Set a function that decides whether to accept an incoming TCP connection.
+ *
+ * The function is called on the node's event loop thread right after a TCP
+ * connection is accepted, before anything is read from it, with the address of
+ * the remote peer. If it returns nonzero, the connection is closed. This can be
+ * used to implement an allowlist or denylist of client networks when there is
+ * no firewall in front of the node. The function must not block. @arg is a user
+ * data parameter that will be passed to all invocations of the function.
+ *
+ * Connections to other nodes in the cluster are accepted on the same listener,
+ * so take care to allow their addresses. Unix socket connections are not passed
+ * to this function, since they're only accepted from the same process.
+ *
+ * This function must be called before calling dqlite_node_start().
+ */
+DQLITE_API int dqlite_node_set_accept_func(dqlite_node *n,
+					   int (*f)(void *arg,
+						    const struct sockaddr *addr),
+					   void *arg);
+
 /**
  * DEPRECATED - USE `dqlite_node_set_network_latency_ms`
  * Set the average one-way network latency, expressed in nanoseconds.
@@ -370,6 +495,38 @@ DQLITE_API int dqlite_node_set_network_latency_ms(dqlite_node *t,
 DQLITE_API int dqlite_node_set_failure_domain(dqlite_node *n,
 					      unsigned long long code);
 
+/**
+ * Set the weight associated with this node.
+ *
+ * Like the failure domain, this is a tag that can be inspected with the
+ * "Describe node" client request. When automatic role management is enabled,
+ * nodes with a lower weight are preferred for promotion.
+ */
+DQLITE_API int dqlite_node_set_weight(dqlite_node *n, unsigned long long weight);
+
+/**
+ * Set the TCP keepalive parameters for incoming TCP connections.
+ *
+ * If @delay is nonzero, keepalive probes are sent on connections that have
+ * been idle for @delay seconds. If @timeout is nonzero, a connection is dropped
+ * when transmitted data stays unacknowledged for more than @timeout
+ * milliseconds (this uses TCP_USER_TIMEOUT and is ignored on platforms that
+ * lack it). Together they let the node detect dead peers behind NATs and
+ * firewalls quickly. Both are disabled by default.
+ *
+ * Only connections accepted by this node are configured. Outgoing connections,
+ * to other nodes and from a dqlite_server's client, are opened by the connect
+ * function (see dqlite_node_set_connect_func and
+ * dqlite_server_set_connect_func), and the default one doesn't apply these
+ * settings. A custom connect function must set the socket options itself if
+ * the connecting side should detect a dead peer too.
+ *
+ * This function must be called before calling dqlite_node_start().
+ */
+DQLITE_API int dqlite_node_set_tcp_keepalive(dqlite_node *n,
+					     unsigned delay,
+					     unsigned timeout);
+
 /**
  * Set the snapshot parameters for this node.
  *
@@ -391,6 +548,57 @@ DQLITE_API int dqlite_node_set_snapshot_params(dqlite_node *n,
 					       unsigned snapshot_threshold,
 					       unsigned snapshot_trailing);
 
+/**
+ * Set the maximum size, in bytes, of a single request that this node will
+ * accept from a client or another node.
+ *
+ * The body of a larger request is never read, so a misbehaving client can't
+ * make the node allocate an arbitrary amount of memory, or keep it busy reading
+ * a body it will reject. The request is answered with a SQLITE_TOOBIG failure
+ * ("request too large") and the connection is closed right away. Since the
+ * unread body is dropped, the client may see the connection reset before it
+ * reads the failure. The CONNECT request that another node sends to hand a
+ * connection over to raft, and the raft traffic that follows it, are not
+ * subject to this limit. The default is 0, meaning no limit beyond the
+ * protocol's own.
+ *
+ * This function must be called before calling dqlite_node_start().
+ */
+DQLITE_API int dqlite_node_set_max_request_size(dqlite_node *n, size_t size);
+
+/**
+ * Set the maximum number of connections this node will serve at once.
+ *
+ * A connection is counted from the moment it's accepted, including while it's
+ * idle or has only sent the protocol handshake. When the limit is reached, new
+ * connections are accepted and immediately closed, so a connection storm can't
+ * exhaust the node's file descriptors. A connection from another node stops
+ * being counted once raft takes it over, but is refused like any other while
+ * the limit is reached, so leave some headroom for them. The default is 0,
+ * meaning no limit.
+ *
+ * The limit applies to the node as a whole: there is no separate limit per
+ * peer address, so a single client can use all of the available connections.
+ *
+ * This function must be called before calling dqlite_node_start().
+ */
+DQLITE_API int dqlite_node_set_max_connections(dqlite_node *n, unsigned max);
+
+/**
+ * Set the WAL size, in frames, above which this node checkpoints a database.
+ *
+ * After each write transaction is applied, a node checks whether the WAL of
+ * the affected database has grown to at least @frames frames, and if so
+ * checkpoints it into the database file. A lower value keeps the WAL, and so
+ * memory usage, small at the cost of more frequent checkpoints. The default is
+ * 1000 frames. Each node checkpoints independently, so the value does not need
+ * to be the same across the cluster.
+ *
+ * This function must be called before calling dqlite_node_start().
+ */
+DQLITE_API int dqlite_node_set_checkpoint_threshold(dqlite_node *n,
+						    unsigned frames);
+
 /**
  * Set the block size used for performing disk IO when writing raft log segments
  * to disk. @size is limited to a list of preset values.
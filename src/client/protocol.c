@@ -3,6 +3,7 @@
 #include <poll.h>
 #include <stdint.h>
 #include <stdlib.h>
+#include <time.h>
 #include <unistd.h>
 
 #include "../lib/assert.h"
@@ -512,6 +513,15 @@ int clientSendClient(struct client_proto *c,
 	return 0;
 }
 
+int clientSendHeartbeat(struct client_proto *c, struct client_context *context)
+{
+	tracef("client send heartbeat");
+	struct request_heartbeat request;
+	request.timestamp = (uint64_t)time(NULL);
+	REQUEST(heartbeat, HEARTBEAT, 0);
+	return 0;
+}
+
 int clientSendOpen(struct client_proto *c,
 		   const char *name,
 		   struct client_context *context)
@@ -128,6 +128,11 @@ DQLITE_VISIBLE_TO_TESTS int clientSendClient(struct client_proto *c,
 					     uint64_t id,
 					     struct client_context *context);
 
+/* Send a heartbeat to check that the attached server is alive. The server
+ * answers with an empty response. */
+DQLITE_VISIBLE_TO_TESTS int clientSendHeartbeat(struct client_proto *c,
+						struct client_context *context);
+
 /* Send a request to open a database */
 DQLITE_VISIBLE_TO_TESTS int clientSendOpen(struct client_proto *c,
 					   const char *name,
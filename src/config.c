@@ -55,6 +55,10 @@ int config__init(struct config *c,
 	c->voters = 3;
 	c->standbys = 0;
 	c->pool_thread_count = 4;
+	c->tcp_keepalive = 0;
+	c->tcp_user_timeout = 0;
+	c->max_request_size = 0;
+	c->max_connections = 0;
 	serial++;
 	return 0;
 }
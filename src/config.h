@@ -21,6 +21,10 @@ struct config {
 	int voters;                        /* Target number of voters */
 	int standbys;                      /* Target number of standbys */
 	unsigned pool_thread_count;    /* Number of threads in thread pool */
+	unsigned tcp_keepalive;        /* Keepalive idle time in seconds */
+	unsigned tcp_user_timeout;     /* In milliseconds */
+	size_t max_request_size;       /* In bytes, 0 means no limit */
+	unsigned max_connections;      /* 0 means no limit */
 };
 
 /**
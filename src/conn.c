@@ -2,6 +2,7 @@
 #include "message.h"
 #include "protocol.h"
 #include "request.h"
+#include "response.h"
 #include "tracing.h"
 #include "transport.h"
 
@@ -103,6 +104,8 @@ abort:
 static void closeCb(struct transport *transport)
 {
 	struct conn *c = transport->data;
+	assert(*c->n_conns > 0);
+	*c->n_conns -= 1;
 	buffer__close(&c->write);
 	buffer__close(&c->read);
 	if (c->close_cb != NULL) {
@@ -110,6 +113,53 @@ static void closeCb(struct transport *transport)
 	}
 }
 
+static void failure_write_cb(struct transport *transport, int status)
+{
+	struct conn *c = transport->data;
+	if (status != 0) {
+		tracef("write cb status %d", status);
+	}
+	conn__stop(c);
+}
+
+/* Reply to the current request with a failure response, then close the
+ * connection. */
+static void conn_failure(struct conn *c, uint64_t code, const char *message)
+{
+	struct response_failure failure;
+	char *cursor;
+	uv_buf_t buf;
+	size_t n;
+	int rv;
+
+	failure.code = code;
+	failure.message = message;
+	n = response_failure__sizeof(&failure);
+	assert(n % 8 == 0);
+
+	buffer__reset(&c->write);
+	cursor = buffer__advance(&c->write, message__sizeof(&c->response) + n);
+	/* The buffer has at least 4096 bytes, and error messages are shorter
+	 * than that. So this can't fail. */
+	assert(cursor != NULL);
+
+	c->response.type = DQLITE_RESPONSE_FAILURE;
+	c->response.words = (uint32_t)(n / 8);
+	c->response.schema = 0;
+	c->response.extra = 0;
+	message__encode(&c->response, &cursor);
+	response_failure__encode(&failure, &cursor);
+
+	buf.base = buffer__cursor(&c->write, 0);
+	buf.len = buffer__offset(&c->write);
+
+	rv = transport__write(&c->transport, &buf, failure_write_cb);
+	if (rv != 0) {
+		tracef("transport write failed %d", rv);
+		conn__stop(c);
+	}
+}
+
 static void raft_connect(struct conn *c)
 {
 	struct cursor *cursor = &c->handle.cursor;
@@ -171,6 +221,15 @@ static int read_request(struct conn *c)
 	if (UINT64_C(8) * (uint64_t)c->request.words > (uint64_t)UINT32_MAX) {
 		return DQLITE_ERROR;
 	}
+	/* The CONNECT request carries raft traffic, which isn't limited. */
+	if (c->config->max_request_size > 0 &&
+	    c->request.type != DQLITE_REQUEST_CONNECT &&
+	    (size_t)c->request.words * 8 > c->config->max_request_size) {
+		tracef("request too large (%" PRIu32 " words)",
+		       c->request.words);
+		conn_failure(c, SQLITE_TOOBIG, "request too large");
+		return 0;
+	}
 	rv = init_read(c, &buf, c->request.words * 8);
 	if (rv != 0) {
 		tracef("init read failed %d", rv);
@@ -297,6 +356,7 @@ int conn__start(struct conn *c,
 		struct uv_stream_s *stream,
 		struct raft_uv_transport *uv_transport,
 		struct id_state seed,
+		unsigned *n_conns,
 		conn_close_cb close_cb)
 {
 	int rv;
@@ -321,12 +381,14 @@ int conn__start(struct conn *c,
 		goto err_after_read_buffer_init;
 	}
 	c->handle.data = c;
+	c->n_conns = n_conns;
 	c->closed = false;
 	/* First, we expect the client to send us the protocol version. */
 	rv = read_protocol(c);
 	if (rv != 0) {
 		goto err_after_write_buffer_init;
 	}
+	*c->n_conns += 1;
 	return 0;
 
 err_after_write_buffer_init:
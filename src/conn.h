@@ -33,6 +33,7 @@ struct conn
 	struct message request;                 /* Request message meta data */
 	struct message response;                /* Response message meta data */
 	struct handle handle;
+	unsigned *n_conns;                      /* Open connections of node */
 	bool closed;
 	queue queue;
 };
@@ -42,6 +43,9 @@ struct conn
  *
  * If no error is returned, the connection should be considered started. Any
  * error occurring after this point will trigger the @close_cb callback.
+ *
+ * The connection is counted in @n_conns until it's closed or handed over to
+ * raft.
  */
 int conn__start(struct conn *c,
 		struct config *config,
@@ -51,6 +55,7 @@ int conn__start(struct conn *c,
 		struct uv_stream_s *stream,
 		struct raft_uv_transport *uv_transport,
 		struct id_state seed,
+		unsigned *n_conns,
 		conn_close_cb close_cb);
 
 /**
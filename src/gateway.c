@@ -263,6 +263,20 @@ static int handle_client(struct gateway *g, struct handle *req)
 	return 0;
 }
 
+/* Answer a ping from the client. This doesn't touch raft or the database, so
+ * a client can use it on an idle connection to check that the server is still
+ * there, whether or not it's the leader. */
+static int handle_heartbeat(struct gateway *g, struct handle *req)
+{
+	tracef("handle heartbeat");
+	struct cursor *cursor = &req->cursor;
+	START_V0(heartbeat, empty);
+	(void)g;
+	(void)request;
+	SUCCESS_V0(empty, EMPTY);
+	return 0;
+}
+
 static int handle_open(struct gateway *g, struct handle *req)
 {
 	tracef("handle open");
@@ -1398,14 +1412,28 @@ static int handle_describe(struct gateway *g, struct handle *req)
 {
 	tracef("handle describe");
 	struct cursor *cursor = &req->cursor;
+	struct response_metadata_v1 response_v1 = { 0 };
 	START_V0(describe, metadata);
-	if (request.format != DQLITE_REQUEST_DESCRIBE_FORMAT_V0) {
-		tracef("bad format");
-		failure(req, SQLITE_PROTOCOL, "bad format version");
+	switch (request.format) {
+		case DQLITE_REQUEST_DESCRIBE_FORMAT_V0:
+			response.failure_domain = g->config->failure_domain;
+			response.weight = g->config->weight;
+			SUCCESS_V0(metadata, METADATA);
+			break;
+		case DQLITE_REQUEST_DESCRIBE_FORMAT_V1:
+			response_v1.failure_domain = g->config->failure_domain;
+			response_v1.weight = g->config->weight;
+			response_v1.term = g->raft->current_term;
+			response_v1.last_index = raft_last_index(g->raft);
+			response_v1.commit_index = g->raft->commit_index;
+			response_v1.last_applied = raft_last_applied(g->raft);
+			SUCCESS(metadata_v1, METADATA_V1, response_v1, 0);
+			break;
+		default:
+			tracef("bad format");
+			failure(req, SQLITE_PROTOCOL, "bad format version");
+			break;
 	}
-	response.failure_domain = g->config->failure_domain;
-	response.weight = g->config->weight;
-	SUCCESS_V0(metadata, METADATA);
 	return 0;
 }
 
@@ -54,6 +54,7 @@ enum {
 #define DQLITE_REQUEST_CLUSTER_FORMAT_V1 1 /* ID, address and role */
 
 #define DQLITE_REQUEST_DESCRIBE_FORMAT_V0 0 /* Failure domain and weight */
+#define DQLITE_REQUEST_DESCRIBE_FORMAT_V1 1 /* V0 plus raft term and indexes */
 
 /* These apply to REQUEST_EXEC, REQUEST_EXEC_SQL, REQUEST_QUERY, and
  * REQUEST_QUERY_SQL. */
@@ -81,7 +82,8 @@ enum {
 	DQLITE_RESPONSE_ROWS,
 	DQLITE_RESPONSE_EMPTY,
 	DQLITE_RESPONSE_FILES,
-	DQLITE_RESPONSE_METADATA
+	DQLITE_RESPONSE_METADATA,
+	DQLITE_RESPONSE_METADATA_V1 = DQLITE_RESPONSE_METADATA
 };
 
 #endif /* DQLITE_PROTOCOL_H_ */
@@ -9,6 +9,7 @@
 
 #define REQUEST_LEADER(X, ...) X(uint64, __unused__, ##__VA_ARGS__)
 #define REQUEST_CLIENT(X, ...) X(uint64, id, ##__VA_ARGS__)
+#define REQUEST_HEARTBEAT(X, ...) X(uint64, timestamp, ##__VA_ARGS__)
 #define REQUEST_OPEN(X, ...)             \
 	X(text, filename, ##__VA_ARGS__) \
 	X(uint64, flags, ##__VA_ARGS__)  \
@@ -49,6 +50,7 @@
 #define REQUEST__TYPES(X, ...)                               \
 	X(leader, LEADER, __VA_ARGS__)                       \
 	X(client, CLIENT, __VA_ARGS__)                       \
+	X(heartbeat, HEARTBEAT, __VA_ARGS__)                 \
 	X(open, OPEN, __VA_ARGS__)                           \
 	X(prepare, PREPARE, __VA_ARGS__)                     \
 	X(exec, EXEC, __VA_ARGS__)                           \
@@ -37,6 +37,13 @@
 #define RESPONSE_METADATA(X, ...)                \
 	X(uint64, failure_domain, ##__VA_ARGS__) \
 	X(uint64, weight, ##__VA_ARGS__)
+#define RESPONSE_METADATA_V1(X, ...)             \
+	X(uint64, failure_domain, ##__VA_ARGS__) \
+	X(uint64, weight, ##__VA_ARGS__)         \
+	X(uint64, term, ##__VA_ARGS__)           \
+	X(uint64, last_index, ##__VA_ARGS__)     \
+	X(uint64, commit_index, ##__VA_ARGS__)   \
+	X(uint64, last_applied, ##__VA_ARGS__)
 
 #define RESPONSE__DEFINE(LOWER, UPPER, _) \
 	SERIALIZE__DEFINE(response_##LOWER, RESPONSE_##UPPER);
@@ -54,7 +61,8 @@
 	X(empty, EMPTY, __VA_ARGS__)                       \
 	X(files, FILES, __VA_ARGS__)                       \
 	X(servers, SERVERS, __VA_ARGS__)                   \
-	X(metadata, METADATA, __VA_ARGS__)
+	X(metadata, METADATA, __VA_ARGS__)                 \
+	X(metadata_v1, METADATA_V1, __VA_ARGS__)
 
 RESPONSE__TYPES(RESPONSE__DEFINE);
 
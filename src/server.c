@@ -1,6 +1,9 @@
 #include "server.h"
 
 #include <errno.h>
+#include <netdb.h>
+#include <netinet/in.h>
+#include <netinet/tcp.h>
 #include <sched.h>
 #include <stdlib.h>
 #include <sys/un.h>
@@ -14,6 +17,7 @@
 #include "id.h"
 #include "lib/addr.h"
 #include "lib/assert.h"
+#include "lib/byte.h"
 #include "lib/fs.h"
 #include "lib/threadpool.h"
 #include "logger.h"
@@ -32,6 +36,11 @@
 
 #define NODE_STORE_INFO_FORMAT_V1 "v1"
 
+/* Deadline, in milliseconds, for each stage of a dqlite_server's exchanges with
+ * the cluster: the handshake with each server tried, then the rest of an
+ * attempt at joining or of a refresh of the node store. */
+#define SERVER_CLIENT_TIMEOUT 5000
+
 /* Called by raft every time the raft state changes. */
 static void state_cb(struct raft *r,
 		     unsigned short old_state,
@@ -160,6 +169,7 @@ int dqlite__init(struct dqlite_node *d,
 
 	queue_init(&d->queue);
 	queue_init(&d->conns);
+	d->n_conns = 0;
 	queue_init(&d->roles_changes);
 	d->raft_state = RAFT_UNAVAILABLE;
 	d->running = false;
@@ -168,6 +178,8 @@ int dqlite__init(struct dqlite_node *d,
 	d->role_management = false;
 	d->connect_func = transportDefaultConnect;
 	d->connect_func_arg = NULL;
+	d->accept_func = NULL;
+	d->accept_func_arg = NULL;
 
 	urandom = open("/dev/urandom", O_RDONLY);
 	assert(urandom != -1);
@@ -351,6 +363,18 @@ int dqlite_node_set_connect_func(dqlite_node *t,
 	return 0;
 }
 
+int dqlite_node_set_accept_func(dqlite_node *t,
+				int (*f)(void *arg, const struct sockaddr *addr),
+				void *arg)
+{
+	if (t->running) {
+		return DQLITE_MISUSE;
+	}
+	t->accept_func = f;
+	t->accept_func_arg = arg;
+	return 0;
+}
+
 int dqlite_node_set_network_latency(dqlite_node *t,
 				    unsigned long long nanoseconds)
 {
@@ -391,6 +415,24 @@ int dqlite_node_set_failure_domain(dqlite_node *n, unsigned long long code)
 	return 0;
 }
 
+int dqlite_node_set_weight(dqlite_node *n, unsigned long long weight)
+{
+	n->config.weight = weight;
+	return 0;
+}
+
+int dqlite_node_set_tcp_keepalive(dqlite_node *n,
+				  unsigned delay,
+				  unsigned timeout)
+{
+	if (n->running) {
+		return DQLITE_MISUSE;
+	}
+	n->config.tcp_keepalive = delay;
+	n->config.tcp_user_timeout = timeout;
+	return 0;
+}
+
 int dqlite_node_set_snapshot_params(dqlite_node *n,
 				    unsigned snapshot_threshold,
 				    unsigned snapshot_trailing)
@@ -415,6 +457,38 @@ int dqlite_node_set_snapshot_params(dqlite_node *n,
 	return 0;
 }
 
+int dqlite_node_set_max_request_size(dqlite_node *n, size_t size)
+{
+	if (n->running) {
+		return DQLITE_MISUSE;
+	}
+	n->config.max_request_size = size;
+	return 0;
+}
+
+int dqlite_node_set_max_connections(dqlite_node *n, unsigned max)
+{
+	if (n->running) {
+		return DQLITE_MISUSE;
+	}
+	n->config.max_connections = max;
+	return 0;
+}
+
+int dqlite_node_set_checkpoint_threshold(dqlite_node *n, unsigned frames)
+{
+	if (n->running) {
+		return DQLITE_MISUSE;
+	}
+
+	if (frames == 0) {
+		return DQLITE_MISUSE;
+	}
+
+	n->config.checkpoint_threshold = frames;
+	return 0;
+}
+
 #define KB(N) (1024 * N)
 int dqlite_node_set_block_size(dqlite_node *n, size_t size)
 {
@@ -588,6 +662,35 @@ static void startup_cb(uv_timer_t *startup)
 	assert(rv == 0); /* No reason for which posting should fail */
 }
 
+/* Apply the configured keepalive and user timeout to an accepted TCP
+ * connection. */
+static int configureTcpStream(const struct config *config,
+			      struct uv_tcp_s *tcp)
+{
+	int rv;
+
+	if (config->tcp_keepalive > 0) {
+		rv = uv_tcp_keepalive(tcp, 1, config->tcp_keepalive);
+		if (rv != 0) {
+			tracef("uv_tcp_keepalive: %s", uv_strerror(rv));
+			return DQLITE_ERROR;
+		}
+	}
+#if defined(TCP_USER_TIMEOUT)
+	if (config->tcp_user_timeout > 0) {
+		rv = setsockopt(tcp->io_watcher.fd, IPPROTO_TCP,
+				TCP_USER_TIMEOUT, &config->tcp_user_timeout,
+				sizeof config->tcp_user_timeout);
+		if (rv != 0) {
+			tracef("setsockopt TCP_USER_TIMEOUT: %s",
+			       strerror(errno));
+			return DQLITE_ERROR;
+		}
+	}
+#endif
+	return 0;
+}
+
 static void listenCb(uv_stream_t *listener, int status)
 {
 	struct dqlite_node *t = listener->data;
@@ -633,6 +736,36 @@ static void listenCb(uv_stream_t *listener, int status)
 		goto err;
 	}
 
+	/* Reject before starting the connection, so that idle sockets that
+	 * never complete the handshake count towards the limit as well. */
+	if (t->config.max_connections > 0 &&
+	    t->n_conns >= t->config.max_connections) {
+		tracef("too many connections");
+		goto err;
+	}
+
+	if (listener->type == UV_TCP) {
+		if (t->accept_func != NULL) {
+			struct sockaddr_storage addr;
+			int len = sizeof addr;
+			rv = uv_tcp_getpeername((struct uv_tcp_s *)stream,
+						(struct sockaddr *)&addr, &len);
+			if (rv != 0) {
+				goto err;
+			}
+			rv = t->accept_func(t->accept_func_arg,
+					    (struct sockaddr *)&addr);
+			if (rv != 0) {
+				tracef("connection rejected by accept func");
+				goto err;
+			}
+		}
+		rv = configureTcpStream(&t->config, (struct uv_tcp_s *)stream);
+		if (rv != 0) {
+			goto err;
+		}
+	}
+
 	/* We accept unix socket connections only from the same process. */
 	if (listener->type == UV_NAMED_PIPE) {
 		int fd = stream->io_watcher.fd;
@@ -671,7 +804,8 @@ static void listenCb(uv_stream_t *listener, int status)
 		goto err;
 	}
 	rv = conn__start(conn, &t->config, &t->loop, &t->registry, &t->raft,
-			 stream, &t->raft_transport, seed, destroy_conn);
+			 stream, &t->raft_transport, seed, &t->n_conns,
+			 destroy_conn);
 	if (rv != 0) {
 		goto err_after_conn_alloc;
 	}
@@ -1324,6 +1458,9 @@ int dqlite_server_create(const char *path, dqlite_server **server)
 	(*server)->proto.connect = transportDefaultConnect;
 	(*server)->dir_fd = -1;
 	(*server)->refresh_period = 30 * 1000;
+	(*server)->connect_attempts = 1;
+	(*server)->connect_backoff = 100;
+	(*server)->connect_backoff_max = 3 * 1000;
 	return 0;
 }
 
@@ -1378,6 +1515,58 @@ int dqlite_server_set_connect_func(dqlite_server *server,
 	return 0;
 }
 
+int dqlite_server_set_failure_domain(dqlite_server *server,
+				     unsigned long long code)
+{
+	if (server->started) {
+		return 1;
+	}
+	server->failure_domain = code;
+	return 0;
+}
+
+int dqlite_server_set_weight(dqlite_server *server, unsigned long long weight)
+{
+	if (server->started) {
+		return 1;
+	}
+	server->weight = weight;
+	return 0;
+}
+
+int dqlite_server_set_role_management(dqlite_server *server, bool on)
+{
+	if (server->started) {
+		return 1;
+	}
+	server->role_management = on;
+	return 0;
+}
+
+int dqlite_server_set_refresh_period(dqlite_server *server, unsigned msecs)
+{
+	if (server->started || msecs == 0) {
+		return 1;
+	}
+	server->refresh_period = msecs;
+	return 0;
+}
+
+int dqlite_server_set_connect_retry(dqlite_server *server,
+				    unsigned attempts,
+				    unsigned initial_delay,
+				    unsigned max_delay)
+{
+	if (server->started || attempts == 0 || initial_delay == 0 ||
+	    initial_delay > max_delay) {
+		return 1;
+	}
+	server->connect_attempts = attempts;
+	server->connect_backoff = initial_delay;
+	server->connect_backoff_max = max_delay;
+	return 0;
+}
+
 static int openAndHandshake(struct client_proto *proto,
 			    const char *addr,
 			    uint64_t id,
@@ -1398,19 +1587,35 @@ static int openAndHandshake(struct client_proto *proto,
 	return 0;
 }
 
-/* TODO prioritize voters > standbys > spares */
+/* Try to open a connection to one of the nodes in the cache. Voters are tried
+ * first, since they're the most likely to be (or to know) the leader, followed
+ * by standbys and then spares. Each handshake gets a fresh deadline, so that
+ * one unresponsive server can't use up the time of the others. On success, the
+ * deadline is reset again for the caller's next exchanges. */
 static int connectToSomeServer(struct dqlite_server *server,
 			       struct client_context *context)
 {
+	static const int roles[] = { DQLITE_VOTER, DQLITE_STANDBY,
+				     DQLITE_SPARE };
 	unsigned i;
+	unsigned j;
 	int rv;
 
-	for (i = 0; i < server->cache.len; i += 1) {
-		rv = openAndHandshake(&server->proto,
-				      server->cache.nodes[i].addr,
-				      server->cache.nodes[i].id, context);
-		if (rv == 0) {
-			return 0;
+	for (j = 0; j < ARRAY_SIZE(roles); j += 1) {
+		for (i = 0; i < server->cache.len; i += 1) {
+			if (server->cache.nodes[i].role != roles[j]) {
+				continue;
+			}
+			clientContextMillis(context, SERVER_CLIENT_TIMEOUT);
+			rv = openAndHandshake(&server->proto,
+					      server->cache.nodes[i].addr,
+					      server->cache.nodes[i].id,
+					      context);
+			if (rv == 0) {
+				clientContextMillis(context,
+						    SERVER_CLIENT_TIMEOUT);
+				return 0;
+			}
 		}
 	}
 	return 1;
@@ -1458,6 +1663,16 @@ static int tryReconnectToLeader(struct client_proto *proto,
 	return 0;
 }
 
+static void sleepMillis(unsigned long long millis)
+{
+	struct timespec ts;
+
+	ts.tv_sec = (time_t)(millis / 1000);
+	ts.tv_nsec = (long)((millis % 1000) * 1000 * 1000);
+	while (nanosleep(&ts, &ts) != 0 && errno == EINTR) {
+	}
+}
+
 static int refreshNodeStoreCache(struct dqlite_server *server,
 				 struct client_context *context)
 {
@@ -1510,15 +1725,73 @@ static int maybeJoinCluster(struct dqlite_server *server,
 	return 0;
 }
 
-static int bootstrapOrJoinCluster(struct dqlite_server *server,
-				  struct client_context *context)
+/* Make a single attempt to reach the leader, refresh the node store cache and
+ * add this server to the cluster if it's not there yet. Every step is
+ * idempotent, so this can be retried after a failure at any point. */
+static int tryJoinCluster(struct dqlite_server *server,
+			  struct client_context *context)
+{
+	int rv;
+
+	rv = connectToSomeServer(server, context);
+	if (rv != 0) {
+		return 1;
+	}
+
+	rv = tryReconnectToLeader(&server->proto, context);
+	if (rv != 0) {
+		clientClose(&server->proto);
+		return 1;
+	}
+
+	rv = refreshNodeStoreCache(server, context);
+	if (rv != 0) {
+		return 1;
+	}
+
+	rv = maybeJoinCluster(server, context);
+	if (rv != 0) {
+		return 1;
+	}
+	return 0;
+}
+
+/* Join the cluster, retrying with exponential backoff according to the policy
+ * set by dqlite_server_set_connect_retry. See connectToSomeServer for the
+ * deadlines of each attempt. */
+static int joinCluster(struct dqlite_server *server,
+		       struct client_context *context)
+{
+	unsigned long long delay = server->connect_backoff;
+	unsigned i;
+	int rv;
+
+	for (i = 0;; i += 1) {
+		rv = tryJoinCluster(server, context);
+		if (rv == 0) {
+			return 0;
+		}
+		if (i + 1 >= server->connect_attempts) {
+			return 1;
+		}
+		sleepMillis(delay);
+		delay *= 2;
+		if (delay > server->connect_backoff_max) {
+			delay = server->connect_backoff_max;
+		}
+	}
+}
+
+static int bootstrapOrJoinCluster(struct dqlite_server *server)
 {
 	struct client_node_info info;
+	struct client_context context;
 	int rv;
 
 	if (server->is_new && server->bootstrap) {
+		clientContextMillis(&context, SERVER_CLIENT_TIMEOUT);
 		rv = openAndHandshake(&server->proto, server->local_addr,
-				      server->local_id, context);
+				      server->local_id, &context);
 		if (rv != 0) {
 			return 1;
 		}
@@ -1528,22 +1801,7 @@ static int bootstrapOrJoinCluster(struct dqlite_server *server,
 		info.role = DQLITE_VOTER;
 		pushNodeInfo(&server->cache, info);
 	} else {
-		rv = connectToSomeServer(server, context);
-		if (rv != 0) {
-			return 1;
-		}
-
-		rv = tryReconnectToLeader(&server->proto, context);
-		if (rv != 0) {
-			return 1;
-		}
-
-		rv = refreshNodeStoreCache(server, context);
-		if (rv != 0) {
-			return 1;
-		}
-
-		rv = maybeJoinCluster(server, context);
+		rv = joinCluster(server, &context);
 		if (rv != 0) {
 			return 1;
 		}
@@ -1587,7 +1845,7 @@ static void *refreshTask(void *arg)
 		}
 		assert(rv == 0 || rv == ETIMEDOUT);
 
-		clientContextMillis(&context, 5000);
+		clientContextMillis(&context, SERVER_CLIENT_TIMEOUT);
 		if (server->proto.fd == -1) {
 			rv = connectToSomeServer(server, &context);
 			if (rv != 0) {
@@ -1607,6 +1865,79 @@ static void *refreshTask(void *arg)
 	return NULL;
 }
 
+/* Parse @input the way the default connect function does, and render it back
+ * in canonical form: a numeric host, in brackets if it's IPv6, followed by an
+ * explicit port (8080 if @input has none). Return NULL if @input can't be
+ * parsed. */
+static char *normalizeAddress(const char *input)
+{
+	struct sockaddr_storage addr;
+	socklen_t addr_len = sizeof addr;
+	char host[NI_MAXHOST];
+	char port[NI_MAXSERV];
+	char *out;
+	size_t n;
+	int rv;
+
+	rv = AddrParse(input, (struct sockaddr *)&addr, &addr_len, "8080", 0);
+	if (rv != 0) {
+		return NULL;
+	}
+	rv = getnameinfo((struct sockaddr *)&addr, addr_len, host, sizeof host,
+			 port, sizeof port, NI_NUMERICHOST | NI_NUMERICSERV);
+	if (rv != 0) {
+		return NULL;
+	}
+	n = strlen(host) + strlen(port) + 4;
+	out = mallocChecked(n);
+	if (addr.ss_family == AF_INET6) {
+		snprintf(out, n, "[%s]:%s", host, port);
+	} else {
+		snprintf(out, n, "%s:%s", host, port);
+	}
+	return out;
+}
+
+/* Check that the configured addresses can be parsed by the default connect
+ * function, and rewrite them in canonical form, so that a typo is reported by
+ * dqlite_server_start instead of silently breaking leader discovery later, and
+ * so that the same server is always known by the same address. Every malformed
+ * address is traced before DQLITE_MISUSE is returned. When a custom connect
+ * function is used, addresses are opaque to us and nothing is checked. */
+static int normalizeAddresses(struct dqlite_server *server)
+{
+	char *addr;
+	unsigned i;
+	int rv = 0;
+
+	if (server->connect != transportDefaultConnect) {
+		return 0;
+	}
+
+	if (server->local_addr != NULL) {
+		addr = normalizeAddress(server->local_addr);
+		if (addr == NULL) {
+			tracef("invalid address %s", server->local_addr);
+			rv = DQLITE_MISUSE;
+		} else {
+			free(server->local_addr);
+			server->local_addr = addr;
+		}
+	}
+	for (i = 0; i < server->cache.len; i += 1) {
+		addr = normalizeAddress(server->cache.nodes[i].addr);
+		if (addr == NULL) {
+			tracef("invalid seed address %s",
+			       server->cache.nodes[i].addr);
+			rv = DQLITE_MISUSE;
+		} else {
+			free(server->cache.nodes[i].addr);
+			server->cache.nodes[i].addr = addr;
+		}
+	}
+	return rv;
+}
+
 int dqlite_server_start(dqlite_server *server)
 {
 	int info_fd;
@@ -1615,7 +1946,7 @@ int dqlite_server_start(dqlite_server *server)
 	ssize_t size;
 	char *buf;
 	ssize_t n_read;
-	struct client_context context;
+	int status = DQLITE_ERROR;
 	int rv;
 
 	rv = sqlite3_threadsafe();
@@ -1697,6 +2028,11 @@ int dqlite_server_start(dqlite_server *server)
 	}
 
 	if (server->is_new) {
+		rv = normalizeAddresses(server);
+		if (rv != 0) {
+			status = rv;
+			goto err_after_open_store;
+		}
 		server->local_id =
 		    server->bootstrap
 			? BOOTSTRAP_ID
@@ -1720,20 +2056,33 @@ int dqlite_server_start(dqlite_server *server)
 		goto err_after_create_node;
 	}
 
+	rv = dqlite_node_set_failure_domain(server->local,
+					    server->failure_domain);
+	if (rv != 0) {
+		goto err_after_create_node;
+	}
+	rv = dqlite_node_set_weight(server->local, server->weight);
+	if (rv != 0) {
+		goto err_after_create_node;
+	}
+	if (server->role_management) {
+		rv = dqlite_node_enable_role_management(server->local);
+		if (rv != 0) {
+			goto err_after_create_node;
+		}
+	}
+
 	rv = dqlite_node_start(server->local);
 	if (rv != 0) {
 		goto err_after_create_node;
 	}
-	/* TODO set weight and failure domain here */
 
 	rv = writeLocalInfo(server);
 	if (rv != 0) {
 		goto err_after_start_node;
 	}
 
-	clientContextMillis(&context, 5000);
-
-	rv = bootstrapOrJoinCluster(server, &context);
+	rv = bootstrapOrJoinCluster(server);
 	if (rv != 0) {
 		goto err_after_start_node;
 	}
@@ -1759,7 +2108,7 @@ err_after_open_dir:
 	close(server->dir_fd);
 	server->dir_fd = -1;
 err:
-	return 1;
+	return status;
 }
 
 dqlite_node_id dqlite_server_get_id(dqlite_server *server)
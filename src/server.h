@@ -34,8 +34,9 @@ struct dqlite_node {
 	sem_t ready;                             /* Server is ready */
 	sem_t stopped;                           /* Notify loop stopped */
 	sem_t handover_done;
-	queue queue; /* Incoming connections */
-	queue conns; /* Active connections */
+	queue queue;      /* Incoming connections */
+	queue conns;      /* Active connections */
+	unsigned n_conns; /* Length of conns, see conn__start */
 	queue roles_changes;
 	bool running;                 /* Loop is running */
 	struct raft raft;             /* Raft instance */
@@ -54,6 +55,10 @@ struct dqlite_node {
 	    const char *,
 	    int *);             /* Connection function for role management */
 	void *connect_func_arg; /* User data for connection function */
+	int (*accept_func)(
+	    void *,
+	    const struct sockaddr *); /* Filter for incoming TCP connections */
+	void *accept_func_arg;        /* User data for accept function */
 	char errmsg[DQLITE_ERRMSG_BUF_SIZE]; /* Last error occurred */
 	struct id_state random_state;        /* For seeding ID generation */
 };
@@ -90,7 +95,13 @@ struct dqlite_server {
 	char *bind_addr;  /* owned */
 	dqlite_connect_func connect;
 	void *connect_arg;
+	unsigned long long failure_domain;
+	unsigned long long weight;
+	bool role_management;
 	unsigned long long refresh_period; /* in milliseconds */
+	unsigned connect_attempts;
+	unsigned long long connect_backoff;     /* in milliseconds */
+	unsigned long long connect_backoff_max; /* in milliseconds */
 	int dir_fd;
 };
 
@@ -211,9 +211,9 @@ static void impl_close(struct raft_uv_transport *transport,
 
 int transportDefaultConnect(void *arg, const char *address, int *fd)
 {
-	struct sockaddr_in addr_in;
-	struct sockaddr *addr = (struct sockaddr *)&addr_in;
-	socklen_t addr_len = sizeof addr_in;
+	struct sockaddr_storage addr_storage;
+	struct sockaddr *addr = (struct sockaddr *)&addr_storage;
+	socklen_t addr_len = sizeof addr_storage;
 	int rv;
 	(void)arg;
 
@@ -1,3 +1,4 @@
+#include "../lib/endpoint.h"
 #include "../lib/fs.h"
 #include "../lib/heap.h"
 #include "../lib/runner.h"
@@ -5,9 +6,17 @@
 #include "../lib/sqlite.h"
 
 #include "../../include/dqlite.h"
+#include "../../src/client/protocol.h"
 #include "../../src/protocol.h"
 #include "../../src/utils.h"
 
+#include <netinet/in.h>
+#include <netinet/tcp.h>
+#include <poll.h>
+#include <sys/socket.h>
+#include <sys/stat.h>
+#include <unistd.h>
+
 /******************************************************************************
  *
  * Fixture
@@ -318,6 +327,357 @@ TEST(node, networkLatencyMsTooLarge, setUp, tearDown, 0, node_params)
 	return MUNIT_OK;
 }
 
+/* Connect to the node started by setUpInet. */
+static int connectInet(void)
+{
+	int fd = test_endpoint_connect_loopback(9001);
+	munit_assert_int(fd, !=, -1);
+	return fd;
+}
+
+static int rejectAll(void *arg, const struct sockaddr *addr)
+{
+	unsigned *calls = arg;
+	munit_assert_int(addr->sa_family, ==, AF_INET);
+	*calls += 1;
+	return 1;
+}
+
+TEST(node, acceptFunc, setUpInet, tearDown, 0, NULL)
+{
+	struct fixture *f = data;
+	unsigned calls = 0;
+	char byte;
+	int fd;
+	int rv;
+
+	rv = dqlite_node_set_accept_func(f->node, rejectAll, &calls);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_node_start(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	fd = connectInet();
+
+	/* The node closes the connection without reading anything. */
+	munit_assert_int(read(fd, &byte, 1), ==, 0);
+	munit_assert_uint(calls, ==, 1);
+	close(fd);
+
+	rv = dqlite_node_stop(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+TEST(node, acceptFuncRunning, setUpInet, tearDown, 0, NULL)
+{
+	struct fixture *f = data;
+	unsigned calls = 0;
+	int rv;
+
+	rv = dqlite_node_start(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	rv = dqlite_node_set_accept_func(f->node, rejectAll, &calls);
+	munit_assert_int(rv, !=, 0);
+
+	rv = dqlite_node_stop(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+/* Perform the handshake over the client connection @fd. */
+static void openInetClient(struct client_proto *c, int fd)
+{
+	int rv;
+	memset(c, 0, sizeof *c);
+	buffer__init(&c->read);
+	buffer__init(&c->write);
+	c->fd = fd;
+	rv = clientSendHandshake(c, NULL);
+	munit_assert_int(rv, ==, 0);
+}
+
+/* Connect to the node the way another node does, by sending a CONNECT request
+ * that hands the connection over to raft. */
+static int connectPeer(void)
+{
+	const char *address = "127.0.0.1:9002";
+	uint8_t buf[8 + 8 + 8 + 16] = {0};
+	unsigned i;
+	int fd;
+
+	for (i = 0; i < 8; i++) {
+		buf[i] = (uint8_t)((uint64_t)DQLITE_PROTOCOL_VERSION >> (8 * i));
+	}
+	buf[8] = 3; /* Body words */
+	buf[12] = DQLITE_REQUEST_CONNECT;
+	buf[16] = 2; /* Node ID */
+	memcpy(&buf[24], address, strlen(address) + 1);
+
+	fd = connectInet();
+	munit_assert_int(write(fd, buf, sizeof buf), ==, sizeof buf);
+	return fd;
+}
+
+TEST(node, maxConnections, setUpInet, tearDown, 0, NULL)
+{
+	struct fixture *f = data;
+	struct client_proto client;
+	struct pollfd pfd = {.events = POLLIN};
+	char byte;
+	int peer;
+	int idle;
+	int fd;
+	int i;
+	int rv;
+
+	rv = dqlite_node_set_max_connections(f->node, 1);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_node_start(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	/* A connection from another node is kept open by raft, and stops
+	 * counting towards the limit once raft takes it over. */
+	peer = connectPeer();
+	pfd.fd = peer;
+	munit_assert_int(poll(&pfd, 1, 100), ==, 0);
+
+	/* A connection that hasn't even sent the handshake takes the only
+	 * slot, so the next one is closed without being served. */
+	idle = connectInet();
+	fd = connectInet();
+	munit_assert_int(read(fd, &byte, 1), ==, 0);
+	close(fd);
+	pfd.fd = idle;
+	munit_assert_int(poll(&pfd, 1, 100), ==, 0);
+
+	/* Closing the idle connection frees its slot. */
+	close(idle);
+	for (i = 0; i < 50; i++) {
+		fd = connectInet();
+		pfd.fd = fd;
+		if (poll(&pfd, 1, 100) == 0) {
+			break;
+		}
+		close(fd);
+	}
+	munit_assert_int(i, <, 50);
+	openInetClient(&client, fd);
+	rv = clientSendHeartbeat(&client, NULL);
+	munit_assert_int(rv, ==, 0);
+	rv = clientRecvEmpty(&client, NULL);
+	munit_assert_int(rv, ==, 0);
+	clientClose(&client);
+	close(peer);
+
+	rv = dqlite_node_stop(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+TEST(node, maxConnectionsRunning, setUpInet, tearDown, 0, NULL)
+{
+	struct fixture *f = data;
+	int rv;
+
+	rv = dqlite_node_start(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	rv = dqlite_node_set_max_connections(f->node, 1);
+	munit_assert_int(rv, !=, 0);
+
+	rv = dqlite_node_stop(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+/* Find the node's end of the TCP connection whose client end is @fd. Both ends
+ * live in this process. */
+static int findNodeFd(int fd)
+{
+	struct sockaddr_in local;
+	struct sockaddr_in peer;
+	socklen_t len;
+	int i;
+	int rv;
+
+	len = sizeof local;
+	rv = getsockname(fd, (struct sockaddr *)&local, &len);
+	munit_assert_int(rv, ==, 0);
+	for (i = 0; i < 1024; i++) {
+		len = sizeof peer;
+		if (i == fd ||
+		    getpeername(i, (struct sockaddr *)&peer, &len) != 0) {
+			continue;
+		}
+		if (peer.sin_family == AF_INET &&
+		    peer.sin_port == local.sin_port &&
+		    peer.sin_addr.s_addr == local.sin_addr.s_addr) {
+			return i;
+		}
+	}
+	return -1;
+}
+
+TEST(node, tcpKeepalive, setUpInet, tearDown, 0, NULL)
+{
+	struct fixture *f = data;
+	struct client_proto client;
+	socklen_t len;
+	int value;
+	int fd;
+	int rv;
+
+	rv = dqlite_node_set_tcp_keepalive(f->node, 10, 5000);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_node_start(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	/* The connection is accepted and served. */
+	openInetClient(&client, connectInet());
+	rv = clientSendHeartbeat(&client, NULL);
+	munit_assert_int(rv, ==, 0);
+	rv = clientRecvEmpty(&client, NULL);
+	munit_assert_int(rv, ==, 0);
+
+	/* The node's end of the connection has the configured options. */
+	fd = findNodeFd(client.fd);
+	munit_assert_int(fd, !=, -1);
+	len = sizeof value;
+	rv = getsockopt(fd, SOL_SOCKET, SO_KEEPALIVE, &value, &len);
+	munit_assert_int(rv, ==, 0);
+	munit_assert_int(value, ==, 1);
+	/* The idle time option has a different name on macOS, and the user
+	 * timeout is only set where the platform has it, as in
+	 * configureTcpStream. */
+#if defined(TCP_KEEPIDLE)
+	rv = getsockopt(fd, IPPROTO_TCP, TCP_KEEPIDLE, &value, &len);
+	munit_assert_int(rv, ==, 0);
+	munit_assert_int(value, ==, 10);
+#elif defined(TCP_KEEPALIVE)
+	rv = getsockopt(fd, IPPROTO_TCP, TCP_KEEPALIVE, &value, &len);
+	munit_assert_int(rv, ==, 0);
+	munit_assert_int(value, ==, 10);
+#endif
+#if defined(TCP_USER_TIMEOUT)
+	len = sizeof value;
+	rv = getsockopt(fd, IPPROTO_TCP, TCP_USER_TIMEOUT, &value, &len);
+	munit_assert_int(rv, ==, 0);
+	munit_assert_int(value, ==, 5000);
+#endif
+	clientClose(&client);
+
+	rv = dqlite_node_stop(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+TEST(node, tcpKeepaliveRunning, setUpInet, tearDown, 0, NULL)
+{
+	struct fixture *f = data;
+	int rv;
+
+	rv = dqlite_node_start(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	rv = dqlite_node_set_tcp_keepalive(f->node, 10, 5000);
+	munit_assert_int(rv, !=, 0);
+
+	rv = dqlite_node_stop(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+/* Execute a statement through the given client. */
+static void execSQL(struct client_proto *c, const char *sql)
+{
+	uint64_t last_insert_id;
+	uint64_t rows_affected;
+	int rv;
+
+	rv = clientSendExecSQL(c, sql, NULL, 0, NULL);
+	munit_assert_int(rv, ==, 0);
+	rv = clientRecvResult(c, &last_insert_id, &rows_affected, NULL);
+	munit_assert_int(rv, ==, 0);
+}
+
+/* Return the size of the database file @name of a disk mode node. */
+static off_t diskDatabaseSize(struct fixture *f, const char *name)
+{
+	char path[1024];
+	struct stat st;
+	int rv;
+
+	snprintf(path, sizeof path, "%s/database/%s", f->dir, name);
+	rv = stat(path, &st);
+	munit_assert_int(rv, ==, 0);
+	return st.st_size;
+}
+
+TEST(node, checkpointThreshold, setUpInet, tearDown, 0, NULL)
+{
+	struct fixture *f = data;
+	struct client_proto client;
+	int rv;
+
+	rv = dqlite_node_set_checkpoint_threshold(f->node, 0);
+	munit_assert_int(rv, ==, DQLITE_MISUSE);
+	rv = dqlite_node_set_checkpoint_threshold(f->node, 3);
+	munit_assert_int(rv, ==, 0);
+
+	/* In disk mode the database file is on disk, and it's only written by
+	 * checkpoints. */
+	rv = dqlite_node_enable_disk_mode(f->node);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_node_start(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	openInetClient(&client, connectInet());
+	rv = clientSendOpen(&client, "test", NULL);
+	munit_assert_int(rv, ==, 0);
+	rv = clientRecvDb(&client, NULL);
+	munit_assert_int(rv, ==, 0);
+
+	/* Creating the table writes two frames, which stay in the WAL. */
+	execSQL(&client, "CREATE TABLE test (n INT)");
+	munit_assert_llong(diskDatabaseSize(f, "test"), ==, 0);
+
+	/* The third frame reaches the threshold, and the WAL is checkpointed
+	 * into the database file. */
+	execSQL(&client, "INSERT INTO test(n) VALUES(1)");
+	munit_assert_llong(diskDatabaseSize(f, "test"), >, 0);
+
+	clientClose(&client);
+
+	rv = dqlite_node_stop(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+TEST(node, checkpointThresholdRunning, setUp, tearDown, 0, node_params)
+{
+	struct fixture *f = data;
+	int rv;
+
+	rv = dqlite_node_start(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	rv = dqlite_node_set_checkpoint_threshold(f->node, 100);
+	munit_assert_int(rv, ==, DQLITE_MISUSE);
+
+	rv = dqlite_node_stop(f->node);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
 TEST(node, blockSize, setUp, tearDown, 0, NULL)
 {
 	struct fixture *f = data;
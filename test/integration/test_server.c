@@ -1,9 +1,11 @@
 #include "../../include/dqlite.h"
 #include "../../src/server.h"
+#include "../lib/endpoint.h"
 #include "../lib/fs.h"
 #include "../lib/munit.h"
 #include "../lib/runner.h"
 
+#include <pthread.h>
 #include <stdio.h>
 #include <time.h>
 
@@ -68,7 +70,8 @@ void start_each_server(struct fixture *f)
 	munit_assert_int(rv, ==, 0);
 	rv = dqlite_server_set_auto_bootstrap(f->servers[0], true);
 	munit_assert_int(rv, ==, 0);
-	f->servers[0]->refresh_period = 100;
+	rv = dqlite_server_set_refresh_period(f->servers[0], 100);
+	munit_assert_int(rv, ==, 0);
 	rv = dqlite_server_start(f->servers[0]);
 	munit_assert_int(rv, ==, 0);
 
@@ -76,7 +79,8 @@ void start_each_server(struct fixture *f)
 	munit_assert_int(rv, ==, 0);
 	rv = dqlite_server_set_auto_join(f->servers[1], addrs, 1);
 	munit_assert_int(rv, ==, 0);
-	f->servers[1]->refresh_period = 100;
+	rv = dqlite_server_set_refresh_period(f->servers[1], 100);
+	munit_assert_int(rv, ==, 0);
 	rv = dqlite_server_start(f->servers[1]);
 	munit_assert_int(rv, ==, 0);
 
@@ -84,7 +88,8 @@ void start_each_server(struct fixture *f)
 	munit_assert_int(rv, ==, 0);
 	rv = dqlite_server_set_auto_join(f->servers[2], addrs, 2);
 	munit_assert_int(rv, ==, 0);
-	f->servers[2]->refresh_period = 100;
+	rv = dqlite_server_set_refresh_period(f->servers[2], 100);
+	munit_assert_int(rv, ==, 0);
 	rv = dqlite_server_start(f->servers[2]);
 	munit_assert_int(rv, ==, 0);
 }
@@ -101,6 +106,35 @@ void stop_each_server(struct fixture *f)
 	munit_assert_int(rv, ==, 0);
 }
 
+/* Records the addresses passed to the connect function, then connects to them
+ * over TCP. */
+struct dial_log
+{
+	pthread_mutex_t mutex;
+	char addrs[8][32];
+	unsigned n;
+};
+
+static int recordingConnect(void *arg, const char *address, int *fd)
+{
+	struct dial_log *log = arg;
+	unsigned port;
+	int rv;
+
+	pthread_mutex_lock(&log->mutex);
+	if (log->n < 8) {
+		snprintf(log->addrs[log->n], sizeof log->addrs[0], "%s",
+			 address);
+		log->n += 1;
+	}
+	pthread_mutex_unlock(&log->mutex);
+
+	rv = sscanf(address, "127.0.0.1:%u", &port);
+	munit_assert_int(rv, ==, 1);
+	*fd = test_endpoint_connect_loopback((unsigned short)port);
+	return *fd == -1 ? 1 : 0;
+}
+
 TEST(server, restart_follower, setup, teardown, 0, NULL)
 {
 	struct fixture *f = data;
@@ -161,6 +195,49 @@ TEST(server, restart_leader, setup, teardown, 0, NULL)
 	return MUNIT_OK;
 }
 
+/* When looking for a server to talk to, voters are tried before spares, even
+ * if they come later in the node store. */
+TEST(server, dial_voters_first, setup, teardown, 0, NULL)
+{
+	struct fixture *f = data;
+	struct dial_log log = {.n = 0};
+	int rv;
+
+	rv = pthread_mutex_init(&log.mutex, NULL);
+	munit_assert_int(rv, ==, 0);
+
+	rv = dqlite_server_set_address(f->servers[0], "127.0.0.1:8880");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_bootstrap(f->servers[0], true);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	/* Nothing listens on the spare's address. */
+	PREPARE_FILE(NODE(1), "server-info", "v1\n127.0.0.1:8881\n2\n");
+	PREPARE_FILE(NODE(1), "node-store",
+		     "v1\n127.0.0.1:8889\n3\nspare\n127.0.0.1:8880\n" NODE0_ID
+		     "\nvoter\n");
+	rv = dqlite_server_set_connect_func(f->servers[1], recordingConnect,
+					    &log);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[1]);
+	munit_assert_int(rv, ==, 0);
+
+	pthread_mutex_lock(&log.mutex);
+	munit_assert_uint(log.n, >=, 1);
+	munit_assert_string_equal(log.addrs[0], "127.0.0.1:8880");
+	pthread_mutex_unlock(&log.mutex);
+
+	rv = dqlite_server_stop(f->servers[1]);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_stop(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+	pthread_mutex_destroy(&log.mutex);
+
+	return MUNIT_OK;
+}
+
 TEST(server, bad_info_file, setup, teardown, 0, NULL)
 {
 	struct fixture *f = data;
@@ -268,3 +345,318 @@ TEST(server, stop_twice, setup, teardown, 0, NULL)
 
 	return MUNIT_OK;
 }
+
+TEST(server, bad_refresh_period, setup, teardown, 0, NULL)
+{
+	struct fixture *f = data;
+	int rv;
+
+	rv = dqlite_server_set_refresh_period(f->servers[0], 0);
+	munit_assert_int(rv, !=, 0);
+
+	rv = dqlite_server_set_address(f->servers[0], "127.0.0.1:8880");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_bootstrap(f->servers[0], true);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_refresh_period(f->servers[0], 100);
+	munit_assert_int(rv, !=, 0);
+	rv = dqlite_server_stop(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+TEST(server, bad_auto_join_address, setup, teardown, 0, NULL)
+{
+	struct fixture *f = data;
+	const char *addrs[] = {"127.0.0.1:8880", "not-an-address"};
+	int rv;
+
+	/* The first seed is reachable, so only the malformed one can make
+	 * the start fail. */
+	rv = dqlite_server_set_address(f->servers[0], "127.0.0.1:8880");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_bootstrap(f->servers[0], true);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	rv = dqlite_server_set_address(f->servers[1], "127.0.0.1:8881");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_join(f->servers[1], addrs, 2);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[1]);
+	munit_assert_int(rv, ==, DQLITE_MISUSE);
+
+	rv = dqlite_server_stop(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+/* Addresses are rewritten in canonical form when the server starts for the
+ * first time. */
+TEST(server, normalize_addresses, setup, teardown, 0, NULL)
+{
+	struct fixture *f = data;
+	const char *addrs[] = {"127.0.0.1:08880"};
+	int rv;
+
+	rv = dqlite_server_set_address(f->servers[0], "127.0.0.1:8880");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_bootstrap(f->servers[0], true);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	rv = dqlite_server_set_address(f->servers[1], "127.0.0.1:08881");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_join(f->servers[1], addrs, 1);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[1]);
+	munit_assert_int(rv, ==, 0);
+	munit_assert_string_equal(f->servers[1]->local_addr, "127.0.0.1:8881");
+
+	rv = dqlite_server_stop(f->servers[1]);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_stop(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+/* Addresses passed on a restart are ignored in favor of the ones stored on
+ * disk, so they aren't validated either. */
+TEST(server, restart_ignores_bad_address, setup, teardown, 0, NULL)
+{
+	struct fixture *f = data;
+	int rv;
+
+	rv = dqlite_server_set_address(f->servers[0], "127.0.0.1:8880");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_bootstrap(f->servers[0], true);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_stop(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	rv = dqlite_server_set_address(f->servers[0], "not-an-address");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_stop(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+TEST(server, bad_connect_retry, setup, teardown, 0, NULL)
+{
+	struct fixture *f = data;
+	int rv;
+
+	rv = dqlite_server_set_connect_retry(f->servers[0], 0, 10, 100);
+	munit_assert_int(rv, !=, 0);
+	rv = dqlite_server_set_connect_retry(f->servers[0], 3, 100, 10);
+	munit_assert_int(rv, !=, 0);
+	rv = dqlite_server_set_connect_retry(f->servers[0], 3, 0, 100);
+	munit_assert_int(rv, !=, 0);
+
+	return MUNIT_OK;
+}
+
+TEST(server, missing_bootstrap_with_retries, setup, teardown, 0, NULL)
+{
+	struct fixture *f = data;
+	const char *addrs[] = {"127.0.0.1:8880"};
+	int rv;
+
+	rv = dqlite_server_set_address(f->servers[1], "127.0.0.1:8881");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_join(f->servers[1], addrs, 1);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_connect_retry(f->servers[1], 3, 10, 20);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[1]);
+	munit_assert_int(rv, !=, 0);
+
+	return MUNIT_OK;
+}
+
+static void *startServer(void *arg)
+{
+	dqlite_server *server = arg;
+	int rv;
+
+	rv = dqlite_server_start(server);
+	return (void *)(intptr_t)rv;
+}
+
+TEST(server, join_before_bootstrap, setup, teardown, 0, NULL)
+{
+	struct fixture *f = data;
+	const char *addrs[] = {"127.0.0.1:8880"};
+	struct timespec ts = {0, 200 * 1000 * 1000};
+	pthread_t thread;
+	void *result;
+	int rv;
+
+	rv = dqlite_server_set_address(f->servers[1], "127.0.0.1:8881");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_join(f->servers[1], addrs, 1);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_connect_retry(f->servers[1], 20, 50, 500);
+	munit_assert_int(rv, ==, 0);
+	rv = pthread_create(&thread, NULL, startServer, f->servers[1]);
+	munit_assert_int(rv, ==, 0);
+
+	nanosleep(&ts, NULL);
+
+	rv = dqlite_server_set_address(f->servers[0], "127.0.0.1:8880");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_bootstrap(f->servers[0], true);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	rv = pthread_join(thread, &result);
+	munit_assert_int(rv, ==, 0);
+	munit_assert_int((int)(intptr_t)result, ==, 0);
+
+	rv = dqlite_server_stop(f->servers[1]);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_stop(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+/* Connect a client to the server listening on 127.0.0.1 at @port. */
+static void connectClient(struct client_proto *c, unsigned short port)
+{
+	int rv;
+
+	memset(c, 0, sizeof *c);
+	buffer__init(&c->read);
+	buffer__init(&c->write);
+	c->fd = test_endpoint_connect_loopback(port);
+	munit_assert_int(c->fd, !=, -1);
+	rv = clientSendHandshake(c, NULL);
+	munit_assert_int(rv, ==, 0);
+}
+
+TEST(server, failure_domain_and_weight, setup, teardown, 0, NULL)
+{
+	struct fixture *f = data;
+	struct client_proto client;
+	uint64_t failure_domain;
+	uint64_t weight;
+	int rv;
+
+	rv = dqlite_server_set_address(f->servers[0], "127.0.0.1:8880");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_bootstrap(f->servers[0], true);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_failure_domain(f->servers[0], 42);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_weight(f->servers[0], 7);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	connectClient(&client, 8880);
+	rv = clientSendDescribe(&client, NULL);
+	munit_assert_int(rv, ==, 0);
+	rv = clientRecvMetadata(&client, &failure_domain, &weight, NULL);
+	munit_assert_int(rv, ==, 0);
+	munit_assert_uint64(failure_domain, ==, 42);
+	munit_assert_uint64(weight, ==, 7);
+	clientClose(&client);
+
+	rv = dqlite_server_set_failure_domain(f->servers[0], 43);
+	munit_assert_int(rv, !=, 0);
+	rv = dqlite_server_set_weight(f->servers[0], 8);
+	munit_assert_int(rv, !=, 0);
+
+	rv = dqlite_server_stop(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
+
+/* Check whether the server with the given ID is a voter, according to the
+ * server that @client is connected to. */
+static bool isVoter(struct client_proto *client, dqlite_node_id id)
+{
+	struct client_node_info *servers;
+	uint64_t n_servers;
+	bool voter = false;
+	uint64_t i;
+	int rv;
+
+	rv = clientSendCluster(client, NULL);
+	munit_assert_int(rv, ==, 0);
+	rv = clientRecvServers(client, &servers, &n_servers, NULL);
+	munit_assert_int(rv, ==, 0);
+	for (i = 0; i < n_servers; i += 1) {
+		if (servers[i].id == id && servers[i].role == DQLITE_VOTER) {
+			voter = true;
+		}
+		free(servers[i].addr);
+	}
+	free(servers);
+	return voter;
+}
+
+TEST(server, role_management, setup, teardown, 0, NULL)
+{
+	struct fixture *f = data;
+	const char *addrs[] = {"127.0.0.1:8880"};
+	struct timespec ts = {0, 100 * 1000 * 1000};
+	struct client_proto client;
+	dqlite_node_id id;
+	bool voter = false;
+	unsigned i;
+	int rv;
+
+	rv = dqlite_server_set_address(f->servers[0], "127.0.0.1:8880");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_bootstrap(f->servers[0], true);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_role_management(f->servers[0], true);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	rv = dqlite_server_set_address(f->servers[1], "127.0.0.1:8881");
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_auto_join(f->servers[1], addrs, 1);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_role_management(f->servers[1], true);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_start(f->servers[1]);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_set_role_management(f->servers[1], false);
+	munit_assert_int(rv, !=, 0);
+
+	/* The second server joins as a spare, and the leader promotes it the
+	 * next time it adjusts roles, which happens once per second. */
+	id = dqlite_server_get_id(f->servers[1]);
+	connectClient(&client, 8880);
+	for (i = 0; i < 50 && !voter; i += 1) {
+		nanosleep(&ts, NULL);
+		voter = isVoter(&client, id);
+	}
+	clientClose(&client);
+	munit_assert_true(voter);
+
+	rv = dqlite_server_stop(f->servers[1]);
+	munit_assert_int(rv, ==, 0);
+	rv = dqlite_server_stop(f->servers[0]);
+	munit_assert_int(rv, ==, 0);
+
+	return MUNIT_OK;
+}
@@ -123,6 +123,29 @@ int test_endpoint_connect(struct test_endpoint *e)
 	return fd;
 }
 
+int test_endpoint_connect_loopback(unsigned short port)
+{
+	struct sockaddr_in address = {0};
+	int fd;
+	int rv;
+
+	fd = socket(AF_INET, SOCK_STREAM, 0);
+	if (fd < 0) {
+		munit_errorf("socket(): %s", strerror(errno));
+	}
+
+	address.sin_family = AF_INET;
+	address.sin_port = htons(port);
+	address.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+	rv = connect(fd, (struct sockaddr *)&address, sizeof address);
+	if (rv != 0) {
+		close(fd);
+		return -1;
+	}
+
+	return fd;
+}
+
 int test_endpoint_accept(struct test_endpoint *e)
 {
 	struct sockaddr_in in_address;
@@ -46,6 +46,11 @@ void test_endpoint_tear_down(struct test_endpoint *e);
 /* Establish a new client connection. */
 int test_endpoint_connect(struct test_endpoint *e);
 
+/* Connect to the given TCP port on the IPv4 loopback interface, where a dqlite
+ * node or server under test is listening. Return the connected socket, or -1
+ * if the connection failed. */
+int test_endpoint_connect_loopback(unsigned short port);
+
 /* Accept a new client connection. */
 int test_endpoint_accept(struct test_endpoint *e);
 
@@ -13,9 +13,12 @@
 #include "../../src/gateway.h"
 #include "../../src/lib/threadpool.h"
 #include "../../src/lib/transport.h"
+#include "../../src/protocol.h"
 #include "../../src/raft.h"
 #include "../../src/transport.h"
 
+#include <unistd.h>
+
 TEST_MODULE(conn);
 
 /******************************************************************************
@@ -36,14 +39,15 @@ static void connCloseCb(struct conn *conn)
 	conn_test->closed = true;
 }
 
-#define FIXTURE           \
-	FIXTURE_LOGGER;   \
-	FIXTURE_VFS;      \
-	FIXTURE_CONFIG;   \
-	FIXTURE_REGISTRY; \
-	FIXTURE_RAFT;     \
-	FIXTURE_CLIENT;   \
-	struct conn_test conn_test;
+#define FIXTURE                     \
+	FIXTURE_LOGGER;             \
+	FIXTURE_VFS;                \
+	FIXTURE_CONFIG;             \
+	FIXTURE_REGISTRY;           \
+	FIXTURE_RAFT;               \
+	FIXTURE_CLIENT;             \
+	struct conn_test conn_test; \
+	unsigned n_conns;
 
 #define SETUP                                                                \
 	struct uv_stream_s *stream;                                          \
@@ -65,9 +69,10 @@ static void connCloseCb(struct conn *conn)
 	rv = transport__stream(&f->loop, f->server, &stream);                \
 	munit_assert_int(rv, ==, 0);                                         \
 	f->conn_test.closed = false;                                         \
+	f->n_conns = 0;                                                      \
 	rv = conn__start(&f->conn_test.conn, &f->config, &f->loop,           \
 			 &f->registry, &f->raft, stream, &f->raft_transport, \
-			 seed, connCloseCb);                                 \
+			 seed, &f->n_conns, connCloseCb);                    \
 	munit_assert_int(rv, ==, 0)
 
 #define TEAR_DOWN                         \
@@ -203,6 +208,84 @@ TEST_CASE(handshake, success, NULL)
 	return MUNIT_OK;
 }
 
+/* A connection is counted from the moment it starts until it's closed. */
+TEST_CASE(handshake, counted, NULL)
+{
+	struct handshake_fixture *f = data;
+	(void)params;
+	munit_assert_uint(f->n_conns, ==, 1);
+	HANDSHAKE_CONN;
+	munit_assert_uint(f->n_conns, ==, 1);
+	conn__stop(&f->conn_test.conn);
+	while (!f->conn_test.closed) {
+		test_uv_run(&f->loop, 1);
+	}
+	munit_assert_uint(f->n_conns, ==, 0);
+	return MUNIT_OK;
+}
+
+/* A CONNECT request from another node is handed over to raft even if it's
+ * larger than the maximum request size, and stops being counted. */
+TEST_CASE(handshake, connect_not_too_large, NULL)
+{
+	struct handshake_fixture *f = data;
+	const char *address = "127.0.0.1:9002";
+	uint8_t buf[8 + 8 + 16] = {0};
+	(void)params;
+	f->config.max_request_size = 8;
+	HANDSHAKE_CONN;
+	buf[0] = 3; /* Body words */
+	buf[4] = DQLITE_REQUEST_CONNECT;
+	buf[8] = 2; /* Node ID */
+	memcpy(&buf[16], address, strlen(address) + 1);
+	munit_assert_int(write(f->client.fd, buf, sizeof buf), ==, sizeof buf);
+	while (!f->conn_test.closed) {
+		test_uv_run(&f->loop, 1);
+	}
+	munit_assert_uint(f->n_conns, ==, 0);
+	return MUNIT_OK;
+}
+
+/******************************************************************************
+ *
+ * Handle a heartbeat request
+ *
+ ******************************************************************************/
+
+TEST_SUITE(heartbeat);
+
+struct heartbeat_fixture {
+	FIXTURE;
+};
+
+TEST_SETUP(heartbeat)
+{
+	struct heartbeat_fixture *f = munit_malloc(sizeof *f);
+	SETUP;
+	HANDSHAKE_CONN;
+	return f;
+}
+
+TEST_TEAR_DOWN(heartbeat)
+{
+	struct heartbeat_fixture *f = data;
+	TEAR_DOWN;
+	free(f);
+}
+
+TEST_CASE(heartbeat, success, NULL)
+{
+	struct heartbeat_fixture *f = data;
+	int rv;
+	(void)params;
+	rv = clientSendHeartbeat(&f->client, NULL);
+	munit_assert_int(rv, ==, 0);
+	test_uv_run(&f->loop, 1);
+	rv = clientRecvEmpty(&f->client, NULL);
+	munit_assert_int(rv, ==, 0);
+	return MUNIT_OK;
+}
+
 /******************************************************************************
  *
  * Handle an open request
@@ -238,6 +321,29 @@ TEST_CASE(open, success, NULL)
 	return MUNIT_OK;
 }
 
+/* A request larger than the configured maximum is failed, and the connection
+ * is closed. */
+TEST_CASE(open, too_large, NULL)
+{
+	struct open_fixture *f = data;
+	char name[128];
+	int rv;
+	(void)params;
+	f->config.max_request_size = 64;
+	memset(name, 'x', sizeof name - 1);
+	name[sizeof name - 1] = '\0';
+	rv = clientSendOpen(&f->client, name, NULL);
+	munit_assert_int(rv, ==, 0);
+	while (!f->conn_test.closed) {
+		test_uv_run(&f->loop, 1);
+	}
+	rv = clientRecvDb(&f->client, NULL);
+	munit_assert_int(rv, ==, DQLITE_CLIENT_PROTO_RECEIVED_FAILURE);
+	munit_assert_uint64(f->client.errcode, ==, SQLITE_TOOBIG);
+	munit_assert_string_equal(f->client.errmsg, "request too large");
+	return MUNIT_OK;
+}
+
 /******************************************************************************
  *
  * Handle an prepare request
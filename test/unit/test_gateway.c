@@ -378,6 +378,59 @@ TEST_CASE(leader, other_node, NULL)
 	return MUNIT_OK;
 }
 
+/******************************************************************************
+ *
+ * heartbeat
+ *
+ ******************************************************************************/
+
+struct heartbeat_fixture {
+	FIXTURE;
+	struct request_heartbeat request;
+	struct response_empty response;
+};
+
+TEST_SUITE(heartbeat);
+TEST_SETUP(heartbeat)
+{
+	struct heartbeat_fixture *f = munit_malloc(sizeof *f);
+	SETUP;
+	return f;
+}
+TEST_TEAR_DOWN(heartbeat)
+{
+	struct heartbeat_fixture *f = data;
+	TEAR_DOWN;
+	free(f);
+}
+
+/* A heartbeat is answered even if there's no leader. */
+TEST_CASE(heartbeat, no_leader, NULL)
+{
+	struct heartbeat_fixture *f = data;
+	(void)params;
+	f->request.timestamp = 123;
+	ENCODE(&f->request, heartbeat);
+	HANDLE(HEARTBEAT);
+	ASSERT_CALLBACK(0, EMPTY);
+	DECODE(&f->response, empty);
+	return MUNIT_OK;
+}
+
+/* A heartbeat is answered by a follower. */
+TEST_CASE(heartbeat, follower, NULL)
+{
+	struct heartbeat_fixture *f = data;
+	(void)params;
+	CLUSTER_ELECT(1);
+	f->request.timestamp = 123;
+	ENCODE(&f->request, heartbeat);
+	HANDLE(HEARTBEAT);
+	ASSERT_CALLBACK(0, EMPTY);
+	DECODE(&f->response, empty);
+	return MUNIT_OK;
+}
+
 /******************************************************************************
  *
  * open
@@ -2291,6 +2344,83 @@ TEST_CASE(request_cluster, unrecognizedFormat, NULL)
 	return MUNIT_OK;
 }
 
+/******************************************************************************
+ *
+ * describe
+ *
+ ******************************************************************************/
+
+struct request_describe_fixture {
+	FIXTURE;
+	struct request_describe request;
+	struct response_metadata response;
+	struct response_metadata_v1 response_v1;
+};
+
+TEST_SUITE(request_describe);
+TEST_SETUP(request_describe)
+{
+	struct request_describe_fixture *f = munit_malloc(sizeof *f);
+	SETUP;
+	CLUSTER_ELECT(0);
+	return f;
+}
+TEST_TEAR_DOWN(request_describe)
+{
+	struct request_describe_fixture *f = data;
+	TEAR_DOWN;
+	free(f);
+}
+
+/* Submit a describe request using the original format. */
+TEST_CASE(request_describe, v0, NULL)
+{
+	struct request_describe_fixture *f = data;
+	(void)params;
+	f->request.format = DQLITE_REQUEST_DESCRIBE_FORMAT_V0;
+	ENCODE(&f->request, describe);
+	HANDLE(DESCRIBE);
+	ASSERT_CALLBACK(0, METADATA);
+	DECODE(&f->response, metadata);
+	munit_assert_int(f->response.failure_domain, ==, 0);
+	munit_assert_int(f->response.weight, ==, 0);
+	return MUNIT_OK;
+}
+
+/* Submit a describe request asking for raft status too. */
+TEST_CASE(request_describe, v1, NULL)
+{
+	struct request_describe_fixture *f = data;
+	(void)params;
+	f->request.format = DQLITE_REQUEST_DESCRIBE_FORMAT_V1;
+	ENCODE(&f->request, describe);
+	HANDLE(DESCRIBE);
+	ASSERT_CALLBACK(0, METADATA_V1);
+	DECODE(&f->response_v1, metadata_v1);
+	munit_assert_uint64(f->response_v1.term, ==,
+			    CLUSTER_RAFT(0)->current_term);
+	munit_assert_uint64(f->response_v1.last_index, ==,
+			    CLUSTER_LAST_INDEX(0));
+	munit_assert_uint64(f->response_v1.commit_index, ==,
+			    CLUSTER_RAFT(0)->commit_index);
+	munit_assert_uint64(f->response_v1.last_applied, ==,
+			    raft_last_applied(CLUSTER_RAFT(0)));
+	return MUNIT_OK;
+}
+
+/* Submit a describe request with an invalid format version. */
+TEST_CASE(request_describe, unrecognizedFormat, NULL)
+{
+	struct request_describe_fixture *f = data;
+	(void)params;
+	f->request.format = 2;
+	ENCODE(&f->request, describe);
+	HANDLE(DESCRIBE);
+	ASSERT_CALLBACK(0, FAILURE);
+	ASSERT_FAILURE(SQLITE_PROTOCOL, "bad format version");
+	return MUNIT_OK;
+}
+
 /******************************************************************************
  *
  * invalid